@@ -9,8 +9,6 @@ import (
 	"math/rand"
 	"net/http"
 	"net/url"
-	"runtime/pprof"
-	"runtime/trace"
 	"strings"
 	"sync"
 	"time"
@@ -19,8 +17,6 @@ import (
 )
 
 const (
-	defaultProfileType = profile.TypeCPU
-
 	defaultDuration     = 10 * time.Second
 	defaultTickInterval = time.Minute
 
@@ -56,6 +52,46 @@ type Agent struct {
 	Trace               bool
 	TraceDuration       time.Duration
 
+	// DeltaProfiles enables delta profile mode, see WithDeltaProfiles.
+	DeltaProfiles bool
+	delta         *deltaCache
+
+	// sources are the profile sources to collect from. If empty, Start
+	// collects from the current process using LocalSource.
+	sources []sourceEntry
+
+	// diagnosticAddr, if set via WithDiagnosticEndpoint, is the address the
+	// on-demand /debug/dump HTTP server listens on.
+	diagnosticAddr   string
+	diagnosticServer *http.Server
+
+	// BlockProfileRate and MutexProfileFraction configure
+	// runtime.SetBlockProfileRate and runtime.SetMutexProfileFraction, see
+	// WithBlockProfileRate and WithMutexProfileFraction. ratesMu guards both,
+	// since ServeProfileRates can update them concurrently with each other and
+	// with restoreProfileRates reading them from Stop.
+	ratesMu              sync.Mutex
+	BlockProfileRate     int
+	MutexProfileFraction int
+
+	// trigger, if set via WithTrigger, drives an additional collection loop
+	// that captures profiles in response to runtime conditions instead of a
+	// fixed tick.
+	trigger Trigger
+
+	// schedules overrides the default interval/duration used for the
+	// per-profile-type collection loop started for a given type, see
+	// WithSchedule.
+	schedules map[profile.ProfileType]schedule
+
+	// cpuTraceSem serializes CPU and execution trace collection against a
+	// LocalSource, since the runtime only supports one of either running at
+	// a time. Other profile types run fully concurrently.
+	cpuTraceSem chan struct{}
+
+	bufPoolsMu sync.Mutex
+	bufPools   map[profile.ProfileType]*sync.Pool
+
 	service   string
 	rawLabels strings.Builder
 
@@ -67,6 +103,14 @@ type Agent struct {
 	tick time.Duration
 	stop chan struct{} // signals the beginning of stop
 	done chan struct{} // closed when stopping is done
+	wg   sync.WaitGroup
+}
+
+// sourceEntry pairs a Source with the instance label to attach to profiles
+// collected from it, derived once at configuration time.
+type sourceEntry struct {
+	source   Source
+	instance string
 }
 
 func New(addr, service string, opts ...Option) *Agent {
@@ -80,6 +124,11 @@ func New(addr, service string, opts ...Option) *Agent {
 		rawClient: http.DefaultClient,
 		logf:      func(format string, v ...interface{}) {},
 
+		delta: newDeltaCache(),
+
+		cpuTraceSem: make(chan struct{}, 1),
+		bufPools:    make(map[profile.ProfileType]*sync.Pool),
+
 		tick: defaultTickInterval,
 		stop: make(chan struct{}),
 		done: make(chan struct{}),
@@ -97,7 +146,46 @@ func (a *Agent) Start(ctx context.Context) error {
 		return fmt.Errorf("failed to start agent: collector address is empty")
 	}
 
-	go a.collectAndSend(ctx)
+	if err := a.startDiagnosticServer(); err != nil {
+		return err
+	}
+
+	a.applyProfileRates()
+
+	sources := a.sources
+	if len(sources) == 0 {
+		sources = []sourceEntry{{
+			source: &LocalSource{
+				CPUProfileDuration: a.CPUProfileDuration,
+				TraceDuration:      a.TraceDuration,
+			},
+		}}
+	}
+
+	for _, se := range sources {
+		se := se
+		for _, ptype := range a.enabledProfileTypes() {
+			ptype := ptype
+			a.wg.Add(1)
+			go func() {
+				defer a.wg.Done()
+				a.runScheduledType(ctx, se.source, se.instance, ptype)
+			}()
+		}
+	}
+
+	if a.trigger != nil {
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			a.runTrigger(ctx, a.trigger)
+		}()
+	}
+
+	go func() {
+		a.wg.Wait()
+		close(a.done)
+	}()
 
 	return nil
 }
@@ -105,54 +193,15 @@ func (a *Agent) Start(ctx context.Context) error {
 func (a *Agent) Stop() error {
 	close(a.stop)
 	<-a.done
+	a.stopDiagnosticServer()
+	a.restoreProfileRates()
 	return nil
 }
 
-func (a *Agent) collectProfile(ctx context.Context, ptype profile.ProfileType, buf *bytes.Buffer) error {
-	switch ptype {
-	case profile.TypeCPU:
-		err := pprof.StartCPUProfile(buf)
-		if err != nil {
-			return fmt.Errorf("failed to start CPU profile: %v", err)
-		}
-		sleep(a.CPUProfileDuration, ctx.Done())
-		pprof.StopCPUProfile()
-	case profile.TypeHeap:
-		err := pprof.WriteHeapProfile(buf)
-		if err != nil {
-			return fmt.Errorf("failed to write heap profile: %v", err)
-		}
-	case profile.TypeBlock,
-		profile.TypeMutex,
-		profile.TypeGoroutine,
-		profile.TypeThreadcreate:
-
-		p := pprof.Lookup(ptype.String())
-		if p == nil {
-			return fmt.Errorf("unknown profile type %v", ptype)
-		}
-		err := p.WriteTo(buf, 0)
-		if err != nil {
-			return fmt.Errorf("failed to write %s profile: %v", ptype, err)
-		}
-	case profile.TypeTrace:
-		err := trace.Start(buf)
-		if err != nil {
-			return fmt.Errorf("failed to start trace: %v", err)
-		}
-		sleep(a.TraceDuration, ctx.Done())
-		trace.Stop()
-	default:
-		return fmt.Errorf("unknown profile type %v", ptype)
-	}
-
-	return nil
-}
-
-func (a *Agent) sendProfile(ctx context.Context, ptype profile.ProfileType, createdAt time.Time, buf *bytes.Buffer) error {
+func (a *Agent) sendProfile(ctx context.Context, ptype profile.ProfileType, createdAt time.Time, isDelta bool, labels string, buf *bytes.Buffer) error {
 	q := url.Values{}
 	q.Set("service", a.service)
-	q.Set("labels", a.rawLabels.String())
+	q.Set("labels", labels)
 	q.Set("type", ptype.String())
 
 	// Set create time for trace
@@ -160,6 +209,10 @@ func (a *Agent) sendProfile(ctx context.Context, ptype profile.ProfileType, crea
 		q.Set("created_at", createdAt.Format("2006-01-02T15:04:05"))
 	}
 
+	if isDelta {
+		q.Set("delta", "true")
+	}
+
 	surl := a.collectorAddr + "/api/0/profiles?" + q.Encode()
 	req, err := http.NewRequest(http.MethodPost, surl, buf)
 	if err != nil {
@@ -204,102 +257,111 @@ func (a *Agent) doRequest(req *http.Request, v io.Writer) error {
 	return nil
 }
 
-func (a *Agent) collectAndSend(ctx context.Context) {
-	defer close(a.done)
+// collectOnce collects a single profile of ptype from source and uploads it,
+// tagging it with instance (see WithMultiSource) and extraLabels (e.g. the
+// reason a Trigger fired) in addition to the Agent's own labels.
+func (a *Agent) collectOnce(ctx context.Context, source Source, ptype profile.ProfileType, instance, extraLabels string, buf *bytes.Buffer) {
+	ctx = withCollectDuration(ctx, ptype, a.scheduleFor(ptype).duration)
+
+	deltaEligible := a.DeltaProfiles && deltaProfileTypes[ptype]
+	if deltaEligible {
+		// The scheduled loop and a Trigger can both collect this same
+		// (ptype, instance) stream concurrently (e.g. WithTrigger capturing
+		// a heap profile on demand); serialize the collect-then-apply
+		// critical section so a.delta's prev is always updated in
+		// collection order.
+		unlock := a.delta.lock(ptype, instance)
+		defer unlock()
+	}
 
-	ctx, cancel := context.WithCancel(ctx)
-	go func() {
-		<-a.stop
-		cancel()
-	}()
+	createdAt := time.Now().UTC()
+	if err := source.CollectProfile(ctx, ptype, buf); err != nil {
+		a.logf("[FAIL] unable to collect profiles: %v", err)
+		buf.Reset()
+		return
+	}
 
-	var (
-		ptype = a.nextProfileType(profile.TypeUnknown)
-		timer = time.NewTimer(tickInterval(0))
+	var isDelta bool
+	if deltaEligible {
+		var err error
+		isDelta, err = a.delta.apply(ptype, instance, buf)
+		if err != nil {
+			a.logf("[FAIL] unable to compute delta for %s profile: %v", ptype, err)
+		}
+	}
 
-		buf bytes.Buffer
-	)
+	labels := a.buildLabels(instance, extraLabels)
+
+	if err := a.sendProfile(ctx, ptype, createdAt, isDelta, labels, buf); err != nil {
+		a.logf("[FAIL] unable to send profiles: %v", err)
+	}
 
-	for {
-		select {
-		case <-a.stop:
-			if !timer.Stop() {
-				<-timer.C
-			}
-			return
-		case <-timer.C:
-			createdAt := time.Now().UTC()
-			if err := a.collectProfile(ctx, ptype, &buf); err != nil {
-				a.logf("[FAIL] unable to collect profiles: %v", err)
-			} else {
-				// XXX WANDA add debug
-				a.logf(" going to send type %v len is %d", ptype, buf.Len())
-				if err := a.sendProfile(ctx, ptype, createdAt, &buf); err != nil {
-					a.logf("[FAIL] unable to send profiles: %v", err)
-				}
-			}
-
-			buf.Reset()
-
-			ptype = a.nextProfileType(ptype)
-
-			var tick time.Duration
-			if ptype == defaultProfileType {
-				// we took the full set of profiles, sleep for the whole tick
-				tick = a.tick
-			}
-
-			timer.Reset(tickInterval(tick))
+	buf.Reset()
+}
+
+// buildLabels combines the Agent's own labels with an optional instance
+// label (WithMultiSource) and extra ad-hoc labels (e.g. from a Trigger).
+func (a *Agent) buildLabels(instance, extra string) string {
+	labels := a.rawLabels.String()
+	for _, l := range []string{instanceLabelPair(instance), extra} {
+		if l == "" {
+			continue
 		}
+		if labels != "" {
+			labels += ","
+		}
+		labels += l
 	}
+	return labels
 }
 
-func (a *Agent) nextProfileType(ptype profile.ProfileType) profile.ProfileType {
-	// special case to choose initial profile type on the first call
-	if ptype == profile.TypeUnknown {
-		return defaultProfileType
+func instanceLabelPair(instance string) string {
+	if instance == "" {
+		return ""
 	}
+	return "instance=" + instance
+}
 
-	for {
-		switch ptype {
-		case profile.TypeCPU:
-			ptype = profile.TypeHeap
-			if a.HeapProfile {
-				return ptype
-			}
-		case profile.TypeHeap:
-			ptype = profile.TypeBlock
-			if a.BlockProfile {
-				return ptype
-			}
-		case profile.TypeBlock:
-			ptype = profile.TypeMutex
-			if a.MutexProfile {
-				return ptype
-			}
-		case profile.TypeMutex:
-			ptype = profile.TypeGoroutine
-			if a.GoroutineProfile {
-				return ptype
-			}
-		case profile.TypeGoroutine:
-			ptype = profile.TypeThreadcreate
-			if a.ThreadcreateProfile {
-				return ptype
-			}
-		case profile.TypeThreadcreate:
-			ptype = profile.TypeTrace
-			if a.Trace {
-				return ptype
-			}
-		case profile.TypeTrace:
-			ptype = profile.TypeCPU
-			if a.CPUProfile {
-				return ptype
-			}
-		}
+// enabledProfileTypes returns every profile type the Agent is configured to
+// collect.
+func (a *Agent) enabledProfileTypes() []profile.ProfileType {
+	var types []profile.ProfileType
+	if a.CPUProfile {
+		types = append(types, profile.TypeCPU)
+	}
+	if a.HeapProfile {
+		types = append(types, profile.TypeHeap)
+	}
+	if a.BlockProfile {
+		types = append(types, profile.TypeBlock)
+	}
+	if a.MutexProfile {
+		types = append(types, profile.TypeMutex)
+	}
+	if a.GoroutineProfile {
+		types = append(types, profile.TypeGoroutine)
+	}
+	if a.ThreadcreateProfile {
+		types = append(types, profile.TypeThreadcreate)
+	}
+	if a.Trace {
+		types = append(types, profile.TypeTrace)
+	}
+	return types
+}
+
+// bufPool returns the sync.Pool of *bytes.Buffer used for collecting
+// profiles of ptype, creating it on first use.
+func (a *Agent) bufPool(ptype profile.ProfileType) *sync.Pool {
+	a.bufPoolsMu.Lock()
+	defer a.bufPoolsMu.Unlock()
 
+	pool, ok := a.bufPools[ptype]
+	if !ok {
+		pool = &sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+		a.bufPools[ptype] = pool
 	}
+	return pool
 }
 
 func tickInterval(d time.Duration) time.Duration {
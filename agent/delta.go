@@ -0,0 +1,236 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	gprofile "github.com/google/pprof/profile"
+
+	"github.com/profefe/profefe/pkg/profile"
+)
+
+// deltaProfileTypes lists the profile types for which delta mode is
+// supported. These are the cumulative profiles, i.e. ones whose sample
+// values only grow over the lifetime of the process; CPU, trace, goroutine
+// and threadcreate profiles are point-in-time snapshots and are always sent
+// as-is.
+var deltaProfileTypes = map[profile.ProfileType]bool{
+	profile.TypeHeap:  true,
+	profile.TypeBlock: true,
+	profile.TypeMutex: true,
+}
+
+// deltaKey identifies a profile stream to diff against its own history. A
+// single Agent can collect from several sources concurrently (see
+// WithMultiSource), so the cache is keyed by profile type and instance, not
+// just by type.
+type deltaKey struct {
+	ptype    profile.ProfileType
+	instance string
+}
+
+// deltaCache keeps the last serialized profile seen for each profile stream
+// so that collectOnce can compute the difference between consecutive
+// collections. A given stream is usually collected sequentially from a
+// single goroutine, but WithTrigger can capture a delta-eligible type
+// on-demand from its own goroutine for the same (ptype, instance) as the
+// scheduled loop; collectOnce uses lock to serialize the collect-then-apply
+// critical section of a stream across goroutines so prev is always updated
+// in collection order. Several streams share one cache, so all access goes
+// through mu.
+type deltaCache struct {
+	mu    sync.Mutex
+	prev  map[deltaKey]*gprofile.Profile
+	locks map[deltaKey]*sync.Mutex
+}
+
+func newDeltaCache() *deltaCache {
+	return &deltaCache{
+		prev:  make(map[deltaKey]*gprofile.Profile),
+		locks: make(map[deltaKey]*sync.Mutex),
+	}
+}
+
+// lock serializes collection of a single (ptype, instance) stream across
+// goroutines, so that concurrent collectors (the scheduled loop and a
+// Trigger) can't interleave their collect-then-apply critical sections and
+// update prev out of collection order. The caller must call the returned
+// unlock func once done.
+func (c *deltaCache) lock(ptype profile.ProfileType, instance string) (unlock func()) {
+	key := deltaKey{ptype: ptype, instance: instance}
+
+	c.mu.Lock()
+	streamLock, ok := c.locks[key]
+	if !ok {
+		streamLock = &sync.Mutex{}
+		c.locks[key] = streamLock
+	}
+	c.mu.Unlock()
+
+	streamLock.Lock()
+	return streamLock.Unlock
+}
+
+// apply replaces buf's contents with the delta between the profile currently
+// in buf and the previously cached profile of the same stream, if any. It
+// reports whether buf now holds a delta profile; when it returns false, buf
+// is left untouched and should be uploaded as a regular, cumulative profile.
+func (c *deltaCache) apply(ptype profile.ProfileType, instance string, buf *bytes.Buffer) (isDelta bool, err error) {
+	cur, err := gprofile.Parse(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return false, fmt.Errorf("failed to parse %s profile for delta: %v", ptype, err)
+	}
+
+	key := deltaKey{ptype: ptype, instance: instance}
+
+	c.mu.Lock()
+	prev := c.prev[key]
+	c.prev[key] = cur
+	c.mu.Unlock()
+
+	if prev == nil {
+		// no baseline yet, this collection becomes the baseline for the next one
+		return false, nil
+	}
+
+	diff, err := subtractProfile(prev, cur)
+	if err != nil {
+		// schema changed between collections (e.g. sample types no longer
+		// match); drop the stale baseline and send this collection in full,
+		// it becomes the new baseline above.
+		return false, nil
+	}
+
+	var out bytes.Buffer
+	if err := diff.Write(&out); err != nil {
+		return false, fmt.Errorf("failed to write %s delta profile: %v", ptype, err)
+	}
+
+	buf.Reset()
+	buf.Write(out.Bytes())
+	return true, nil
+}
+
+// subtractProfile returns a profile holding cur's samples with prev's values
+// subtracted, matching samples by their locations and labels. Samples whose
+// resulting value would be negative in any measurement (a monotonicity
+// violation, e.g. the runtime reset its internal counters) are dropped
+// rather than uploaded with a negative value.
+func subtractProfile(prev, cur *gprofile.Profile) (*gprofile.Profile, error) {
+	if len(prev.SampleType) != len(cur.SampleType) {
+		return nil, fmt.Errorf("sample type count changed: %d != %d", len(prev.SampleType), len(cur.SampleType))
+	}
+	for i, st := range cur.SampleType {
+		if prev.SampleType[i].Type != st.Type || prev.SampleType[i].Unit != st.Unit {
+			return nil, fmt.Errorf("sample type %d changed: %v != %v", i, prev.SampleType[i], st)
+		}
+	}
+
+	prevByKey := make(map[string][]int64, len(prev.Sample))
+	for _, s := range prev.Sample {
+		prevByKey[sampleKey(s)] = s.Value
+	}
+
+	diff := cur.Copy()
+	samples := diff.Sample[:0]
+	for _, s := range diff.Sample {
+		prevValue, ok := prevByKey[sampleKey(s)]
+		if !ok {
+			samples = append(samples, s)
+			continue
+		}
+
+		dropped := false
+		values := make([]int64, len(s.Value))
+		for i, v := range s.Value {
+			values[i] = v - prevValue[i]
+			if values[i] < 0 {
+				dropped = true
+				break
+			}
+		}
+		if dropped {
+			continue
+		}
+
+		s.Value = values
+		samples = append(samples, s)
+	}
+	diff.Sample = samples
+
+	diff.TimeNanos = cur.TimeNanos
+	diff.DurationNanos = cur.TimeNanos - prev.TimeNanos
+	diff.Period = cur.Period
+	diff.PeriodType = cur.PeriodType
+
+	return diff, nil
+}
+
+// sampleKey builds a key identifying a sample by its call stack locations
+// and labels, so that samples can be matched across two profiles of the
+// same type taken at different times.
+//
+// Location.ID and Function.ID are assigned per-write by runtime/pprof's
+// internal builder based on first-encounter order within that single
+// profile write, not a stable cross-profile identity: the same call site
+// can get a different ID in two consecutive collections once unrelated new
+// call sites are exercised in between. Keying on each location's address
+// within its mapping and the function name and line of its frames instead
+// (see locationKey), like google/pprof/profile.Merge's own locationKey
+// does, survives that.
+func sampleKey(s *gprofile.Sample) string {
+	var b strings.Builder
+	for _, loc := range s.Location {
+		locationKey(&b, loc)
+	}
+
+	for _, k := range sortedKeys(s.Label) {
+		fmt.Fprintf(&b, "%s=%v;", k, s.Label[k])
+	}
+	for _, k := range sortedNumKeys(s.NumLabel) {
+		fmt.Fprintf(&b, "%s=%v;", k, s.NumLabel[k])
+	}
+
+	return b.String()
+}
+
+// locationKey writes a stable identity for loc to b: its address within its
+// mapping (falling back to the raw address if loc isn't mapped) plus the
+// name and line of every inlined frame at that address.
+func locationKey(b *strings.Builder, loc *gprofile.Location) {
+	addr := loc.Address
+	if loc.Mapping != nil {
+		fmt.Fprintf(b, "%d@%#x;", loc.Mapping.ID, addr-loc.Mapping.Start)
+	} else {
+		fmt.Fprintf(b, "%#x;", addr)
+	}
+
+	for _, ln := range loc.Line {
+		name := ""
+		if ln.Function != nil {
+			name = ln.Function.Name
+		}
+		fmt.Fprintf(b, "%s:%d;", name, ln.Line)
+	}
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedNumKeys(m map[string][]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,156 @@
+package agent
+
+import (
+	"testing"
+
+	gprofile "github.com/google/pprof/profile"
+)
+
+func testLocation(id, funcID uint64, name string, line int64) *gprofile.Location {
+	return &gprofile.Location{
+		ID:      id,
+		Address: 0x1000 + uint64(line), // same call site, same address, whatever its ID
+		Line: []gprofile.Line{
+			{Function: &gprofile.Function{ID: funcID, Name: name}, Line: line},
+		},
+	}
+}
+
+func TestSampleKeyStableAcrossLocationIDReassignment(t *testing.T) {
+	// Same call site, but runtime/pprof assigned it Location.ID 2 in one
+	// profile write and 3 in the next, as happens once unrelated call sites
+	// are introduced in between. sampleKey must still match them.
+	a := &gprofile.Sample{
+		Location: []*gprofile.Location{testLocation(2, 20, "main.worker", 42)},
+		Value:    []int64{100},
+	}
+	b := &gprofile.Sample{
+		Location: []*gprofile.Location{testLocation(3, 31, "main.worker", 42)},
+		Value:    []int64{150},
+	}
+
+	if sampleKey(a) != sampleKey(b) {
+		t.Fatalf("sampleKey differed across reassigned Location.ID: %q != %q", sampleKey(a), sampleKey(b))
+	}
+}
+
+func TestSampleKeyDiffersForDifferentCallSites(t *testing.T) {
+	a := &gprofile.Sample{
+		Location: []*gprofile.Location{testLocation(1, 10, "main.worker", 42)},
+	}
+	b := &gprofile.Sample{
+		Location: []*gprofile.Location{testLocation(1, 10, "main.other", 7)},
+	}
+
+	if sampleKey(a) == sampleKey(b) {
+		t.Fatalf("sampleKey matched distinct call sites: %q", sampleKey(a))
+	}
+}
+
+func TestSampleKeyIncludesLabels(t *testing.T) {
+	a := &gprofile.Sample{
+		Location: []*gprofile.Location{testLocation(1, 10, "main.worker", 42)},
+		Label:    map[string][]string{"reason": {"cpu high"}},
+	}
+	b := &gprofile.Sample{
+		Location: []*gprofile.Location{testLocation(1, 10, "main.worker", 42)},
+	}
+
+	if sampleKey(a) == sampleKey(b) {
+		t.Fatalf("sampleKey ignored sample labels")
+	}
+}
+
+func sampleType() []*gprofile.ValueType {
+	return []*gprofile.ValueType{{Type: "inuse_space", Unit: "bytes"}}
+}
+
+func TestSubtractProfileSubtractsMatchingSamples(t *testing.T) {
+	locA := testLocation(1, 10, "main.worker", 42)
+	locB := testLocation(2, 11, "main.worker", 42) // same site, reassigned ID
+
+	prev := &gprofile.Profile{
+		SampleType: sampleType(),
+		Sample: []*gprofile.Sample{
+			{Location: []*gprofile.Location{locA}, Value: []int64{100}},
+		},
+	}
+	cur := &gprofile.Profile{
+		SampleType: sampleType(),
+		Sample: []*gprofile.Sample{
+			{Location: []*gprofile.Location{locB}, Value: []int64{150}},
+		},
+	}
+
+	diff, err := subtractProfile(prev, cur)
+	if err != nil {
+		t.Fatalf("subtractProfile() error = %v", err)
+	}
+	if len(diff.Sample) != 1 {
+		t.Fatalf("got %d samples, want 1", len(diff.Sample))
+	}
+	if got := diff.Sample[0].Value[0]; got != 50 {
+		t.Errorf("diff value = %d, want 50", got)
+	}
+}
+
+func TestSubtractProfileKeepsNewSamples(t *testing.T) {
+	loc := testLocation(1, 10, "main.worker", 42)
+
+	prev := &gprofile.Profile{SampleType: sampleType()}
+	cur := &gprofile.Profile{
+		SampleType: sampleType(),
+		Sample: []*gprofile.Sample{
+			{Location: []*gprofile.Location{loc}, Value: []int64{42}},
+		},
+	}
+
+	diff, err := subtractProfile(prev, cur)
+	if err != nil {
+		t.Fatalf("subtractProfile() error = %v", err)
+	}
+	if len(diff.Sample) != 1 || diff.Sample[0].Value[0] != 42 {
+		t.Fatalf("new sample wasn't passed through unchanged: %+v", diff.Sample)
+	}
+}
+
+func TestSubtractProfileDropsNegativeResult(t *testing.T) {
+	loc := testLocation(1, 10, "main.worker", 42)
+
+	// Simulates the runtime resetting its internal counters between
+	// collections, so the "current" value is lower than the baseline.
+	prev := &gprofile.Profile{
+		SampleType: sampleType(),
+		Sample: []*gprofile.Sample{
+			{Location: []*gprofile.Location{loc}, Value: []int64{100}},
+		},
+	}
+	cur := &gprofile.Profile{
+		SampleType: sampleType(),
+		Sample: []*gprofile.Sample{
+			{Location: []*gprofile.Location{loc}, Value: []int64{10}},
+		},
+	}
+
+	diff, err := subtractProfile(prev, cur)
+	if err != nil {
+		t.Fatalf("subtractProfile() error = %v", err)
+	}
+	if len(diff.Sample) != 0 {
+		t.Fatalf("got %d samples, want 0 (negative delta should be dropped)", len(diff.Sample))
+	}
+}
+
+func TestSubtractProfileRejectsSchemaChange(t *testing.T) {
+	prev := &gprofile.Profile{SampleType: sampleType()}
+	cur := &gprofile.Profile{
+		SampleType: []*gprofile.ValueType{
+			{Type: "inuse_space", Unit: "bytes"},
+			{Type: "inuse_objects", Unit: "count"},
+		},
+	}
+
+	if _, err := subtractProfile(prev, cur); err == nil {
+		t.Fatal("subtractProfile() returned nil error for a changed sample type schema")
+	}
+}
@@ -0,0 +1,236 @@
+package agent
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/profefe/profefe/pkg/profile"
+)
+
+const (
+	defaultDiagnosticCPUDuration = 5 * time.Second
+	maxDiagnosticCPUDuration     = 60 * time.Second
+)
+
+// WithDiagnosticEndpoint starts an HTTP server listening on addr that
+// exposes /debug/dump, an on-demand "grab everything now" snapshot separate
+// from the Agent's periodic collect-and-send loop.
+func WithDiagnosticEndpoint(addr string) Option {
+	return func(a *Agent) {
+		a.diagnosticAddr = addr
+	}
+}
+
+func (a *Agent) startDiagnosticServer() error {
+	if a.diagnosticAddr == "" {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/dump", a.handleDiagnosticDump)
+	mux.HandleFunc("/debug/rates", a.ServeProfileRates)
+
+	ln, err := net.Listen("tcp", a.diagnosticAddr)
+	if err != nil {
+		return fmt.Errorf("failed to start diagnostic endpoint: %v", err)
+	}
+
+	a.diagnosticServer = &http.Server{Handler: mux}
+	go a.diagnosticServer.Serve(ln)
+
+	return nil
+}
+
+func (a *Agent) stopDiagnosticServer() {
+	if a.diagnosticServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	a.diagnosticServer.Shutdown(ctx)
+}
+
+func (a *Agent) handleDiagnosticDump(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	dur, err := diagnosticCPUDuration(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name := fmt.Sprintf("%s-%s-%s.tar.gz", filepath.Base(os.Args[0]), start.UTC().Format("20060102T150405Z"), dur)
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+
+	if err := a.writeDiagnosticDump(r.Context(), w, dur); err != nil {
+		a.logf("[FAIL] unable to write diagnostic dump: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// diagnosticCPUDuration returns how long to sample the CPU profile and
+// execution trace for in a diagnostic dump: the "seconds" query parameter if
+// the request set one, clamped to maxDiagnosticCPUDuration, or
+// defaultDiagnosticCPUDuration otherwise.
+func diagnosticCPUDuration(r *http.Request) (time.Duration, error) {
+	s := r.URL.Query().Get("seconds")
+	if s == "" {
+		return defaultDiagnosticCPUDuration, nil
+	}
+
+	seconds, err := strconv.Atoi(s)
+	if err != nil || seconds <= 0 {
+		return 0, fmt.Errorf("invalid seconds parameter %q", s)
+	}
+
+	dur := time.Duration(seconds) * time.Second
+	if dur > maxDiagnosticCPUDuration {
+		dur = maxDiagnosticCPUDuration
+	}
+	return dur, nil
+}
+
+// writeDiagnosticDump writes a gzipped tar archive containing a full
+// one-shot snapshot of the process to w: a CPU profile sampled for
+// cpuDuration, heap, allocs, block, mutex, goroutine (both pprof and
+// debug=2 text), threadcreate, an execution trace, runtime.MemStats as
+// JSON, basic runtime/build info, and the process cmdline and environment.
+func (a *Agent) writeDiagnosticDump(ctx context.Context, w io.Writer, cpuDuration time.Duration) error {
+	gw := gzip.NewWriter(w)
+	defer gw.Close()
+
+	tw := tar.NewWriter(gw)
+	defer tw.Close()
+
+	source := &LocalSource{CPUProfileDuration: cpuDuration, TraceDuration: cpuDuration}
+
+	profiles := []struct {
+		name  string
+		ptype profile.ProfileType
+	}{
+		{"cpu.pprof", profile.TypeCPU},
+		{"heap.pprof", profile.TypeHeap},
+		{"block.pprof", profile.TypeBlock},
+		{"mutex.pprof", profile.TypeMutex},
+		{"goroutine.pprof", profile.TypeGoroutine},
+		{"threadcreate.pprof", profile.TypeThreadcreate},
+		{"trace.pprof", profile.TypeTrace},
+	}
+
+	for _, p := range profiles {
+		release, ok := a.acquireCPUTrace(ctx, source, p.ptype, a.stop)
+		if !ok {
+			return fmt.Errorf("diagnostic dump aborted: agent stopping")
+		}
+		err := dumpSource(ctx, tw, source, p.ptype, p.name)
+		release()
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := dumpLookup(tw, "allocs", "allocs.pprof", 0); err != nil {
+		return err
+	}
+	if err := dumpLookup(tw, "goroutine", "goroutine.txt", 2); err != nil {
+		return err
+	}
+
+	if err := dumpJSON(tw, "memstats.json", memStats()); err != nil {
+		return err
+	}
+
+	if err := dumpText(tw, "runtime.txt", runtimeInfo()); err != nil {
+		return err
+	}
+
+	if err := dumpText(tw, "cmdline.txt", strings.Join(os.Args, " ")); err != nil {
+		return err
+	}
+	if err := dumpText(tw, "environ.txt", strings.Join(os.Environ(), "\n")); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func dumpSource(ctx context.Context, tw *tar.Writer, source Source, ptype profile.ProfileType, name string) error {
+	var buf bytes.Buffer
+	if err := source.CollectProfile(ctx, ptype, &buf); err != nil {
+		return fmt.Errorf("failed to collect %s: %v", name, err)
+	}
+	return writeTarFile(tw, name, buf.Bytes())
+}
+
+func dumpLookup(tw *tar.Writer, lookup, name string, debug int) error {
+	p := pprof.Lookup(lookup)
+	if p == nil {
+		return fmt.Errorf("unknown pprof profile %q", lookup)
+	}
+
+	var buf bytes.Buffer
+	if err := p.WriteTo(&buf, debug); err != nil {
+		return fmt.Errorf("failed to collect %s: %v", name, err)
+	}
+	return writeTarFile(tw, name, buf.Bytes())
+}
+
+func dumpJSON(tw *tar.Writer, name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %v", name, err)
+	}
+	return writeTarFile(tw, name, data)
+}
+
+func dumpText(tw *tar.Writer, name, s string) error {
+	return writeTarFile(tw, name, []byte(s))
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write tar header for %s: %v", name, err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	return nil
+}
+
+func memStats() *runtime.MemStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return &m
+}
+
+func runtimeInfo() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "goos: %s\n", runtime.GOOS)
+	fmt.Fprintf(&b, "goarch: %s\n", runtime.GOARCH)
+	fmt.Fprintf(&b, "version: %s\n", runtime.Version())
+	fmt.Fprintf(&b, "num_cpu: %d\n", runtime.NumCPU())
+	fmt.Fprintf(&b, "gomaxprocs: %d\n", runtime.GOMAXPROCS(0))
+	fmt.Fprintf(&b, "num_goroutine: %d\n", runtime.NumGoroutine())
+	fmt.Fprintf(&b, "pid: %d\n", os.Getpid())
+	return b.String()
+}
@@ -0,0 +1,44 @@
+package agent
+
+// Option configures the Agent returned by New.
+type Option func(a *Agent)
+
+// WithDeltaProfiles enables delta profile mode for the heap, block and mutex
+// profiles (see deltaProfileTypes). Instead of uploading the raw cumulative
+// snapshot taken by the runtime, the agent subtracts the previous snapshot of
+// the same profile type and uploads only the difference, which makes the
+// collected data directly usable for time-series analysis without further
+// post-processing on the collector side.
+func WithDeltaProfiles(enabled bool) Option {
+	return func(a *Agent) {
+		a.DeltaProfiles = enabled
+	}
+}
+
+// WithSource configures the Agent to collect profiles from src instead of
+// the current process. Use this to point the agent at a remote process via
+// HTTPPprofSource, or to supply a custom Source implementation.
+func WithSource(src Source) Option {
+	return func(a *Agent) {
+		a.sources = []sourceEntry{{source: src}}
+	}
+}
+
+// WithMultiSource configures the Agent to collect from several sources
+// concurrently, each on its own collection loop. Profiles uploaded for a
+// source implementing instanceLabeler (as HTTPPprofSource does) carry an
+// additional "instance" label taken from it, so they can be told apart on
+// the collector side; profiles from other sources carry no instance label.
+func WithMultiSource(srcs ...Source) Option {
+	return func(a *Agent) {
+		entries := make([]sourceEntry, len(srcs))
+		for i, src := range srcs {
+			entry := sourceEntry{source: src}
+			if l, ok := src.(instanceLabeler); ok {
+				entry.instance = l.InstanceLabel()
+			}
+			entries[i] = entry
+		}
+		a.sources = entries
+	}
+}
@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strconv"
+)
+
+// WithBlockProfileRate sets the block profile rate the Agent applies via
+// runtime.SetBlockProfileRate on Start. A value of 0 leaves the current
+// rate untouched (the default, since block profiling is off until a rate is
+// set). A negative value enables block profiling at -rate on Start and
+// disables it again on Stop; runtime.SetBlockProfileRate has no way to
+// report its previous value, so there is no other way to restore the
+// pre-Start state.
+func WithBlockProfileRate(rate int) Option {
+	return func(a *Agent) {
+		a.BlockProfileRate = rate
+	}
+}
+
+// WithMutexProfileFraction sets the mutex profile fraction the Agent
+// applies via runtime.SetMutexProfileFraction on Start. A value of 0 leaves
+// the current fraction untouched. A negative value enables mutex profiling
+// at -fraction on Start and disables it again on Stop.
+func WithMutexProfileFraction(fraction int) Option {
+	return func(a *Agent) {
+		a.MutexProfileFraction = fraction
+	}
+}
+
+func (a *Agent) applyProfileRates() {
+	a.ratesMu.Lock()
+	defer a.ratesMu.Unlock()
+
+	if a.BlockProfileRate != 0 {
+		rate := a.BlockProfileRate
+		if rate < 0 {
+			rate = -rate
+		}
+		runtime.SetBlockProfileRate(rate)
+	}
+
+	if a.MutexProfileFraction != 0 {
+		fraction := a.MutexProfileFraction
+		if fraction < 0 {
+			fraction = -fraction
+		}
+		runtime.SetMutexProfileFraction(fraction)
+	}
+}
+
+func (a *Agent) restoreProfileRates() {
+	a.ratesMu.Lock()
+	defer a.ratesMu.Unlock()
+
+	if a.BlockProfileRate < 0 {
+		runtime.SetBlockProfileRate(0)
+	}
+	if a.MutexProfileFraction < 0 {
+		runtime.SetMutexProfileFraction(0)
+	}
+}
+
+// ServeProfileRates is an http.HandlerFunc users can mount on their own
+// mux (the diagnostic endpoint, see WithDiagnosticEndpoint, already serves
+// it at /debug/rates) to inspect or change the block and mutex profile
+// rates at runtime, without restarting the process. GET returns the rates
+// currently configured on the Agent as JSON; POST updates them from the
+// "block_rate" and "mutex_fraction" form values, applying each immediately
+// via runtime. As with WithBlockProfileRate and WithMutexProfileFraction, a
+// negative value is applied as its absolute value and disabled again on Stop.
+func (a *Agent) ServeProfileRates(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if v := r.FormValue("block_rate"); v != "" {
+			rate, err := strconv.Atoi(v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid block_rate: %v", err), http.StatusBadRequest)
+				return
+			}
+			a.ratesMu.Lock()
+			a.BlockProfileRate = rate
+			a.ratesMu.Unlock()
+			if rate < 0 {
+				rate = -rate
+			}
+			runtime.SetBlockProfileRate(rate)
+		}
+
+		if v := r.FormValue("mutex_fraction"); v != "" {
+			fraction, err := strconv.Atoi(v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid mutex_fraction: %v", err), http.StatusBadRequest)
+				return
+			}
+			a.ratesMu.Lock()
+			a.MutexProfileFraction = fraction
+			a.ratesMu.Unlock()
+			if fraction < 0 {
+				fraction = -fraction
+			}
+			runtime.SetMutexProfileFraction(fraction)
+		}
+	}
+
+	a.ratesMu.Lock()
+	rates := struct {
+		BlockProfileRate     int `json:"block_profile_rate"`
+		MutexProfileFraction int `json:"mutex_profile_fraction"`
+	}{
+		BlockProfileRate:     a.BlockProfileRate,
+		MutexProfileFraction: a.MutexProfileFraction,
+	}
+	a.ratesMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rates)
+}
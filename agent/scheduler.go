@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/profefe/profefe/pkg/profile"
+)
+
+// schedule is the interval and duration used for the collection loop
+// started for one profile type.
+type schedule struct {
+	interval time.Duration
+	duration time.Duration
+}
+
+// WithSchedule gives ptype its own collection interval and duration,
+// independent of every other profile type and of the Agent's default tick.
+// This lets, for example, a 30-second CPU profile run without delaying
+// goroutine or heap snapshots taken seconds apart on their own schedule.
+func WithSchedule(ptype profile.ProfileType, interval, duration time.Duration) Option {
+	return func(a *Agent) {
+		if a.schedules == nil {
+			a.schedules = make(map[profile.ProfileType]schedule)
+		}
+		a.schedules[ptype] = schedule{interval: interval, duration: duration}
+	}
+}
+
+// scheduleFor returns the configured schedule for ptype, falling back to
+// the Agent's default tick interval and, for CPU and trace, its configured
+// profile duration.
+func (a *Agent) scheduleFor(ptype profile.ProfileType) schedule {
+	if s, ok := a.schedules[ptype]; ok {
+		if s.interval <= 0 {
+			s.interval = a.tick
+		}
+		return s
+	}
+
+	s := schedule{interval: a.tick}
+	switch ptype {
+	case profile.TypeCPU:
+		s.duration = a.CPUProfileDuration
+	case profile.TypeTrace:
+		s.duration = a.TraceDuration
+	}
+	return s
+}
+
+// conflictsAtRuntime reports whether collecting ptype from source needs
+// exclusive access to the process-wide CPU profiler / tracer. Only
+// LocalSource actually touches those; a remote HTTPPprofSource collecting a
+// CPU profile doesn't contend with anything running locally.
+func conflictsAtRuntime(source Source, ptype profile.ProfileType) bool {
+	if ptype != profile.TypeCPU && ptype != profile.TypeTrace {
+		return false
+	}
+	_, isLocal := source.(*LocalSource)
+	return isLocal
+}
+
+// acquireCPUTrace takes a.cpuTraceSem when collecting ptype from source
+// would conflict at the runtime level (see conflictsAtRuntime), so that the
+// scheduled loop, the trigger loop and the diagnostic dump never call
+// pprof.StartCPUProfile or trace.Start concurrently against the same
+// LocalSource. It reports false, with nothing to release, if stop closes or
+// ctx is done before the lock is free. Every CPU/trace collection path must
+// go through this, not just the scheduled loop.
+func (a *Agent) acquireCPUTrace(ctx context.Context, source Source, ptype profile.ProfileType, stop <-chan struct{}) (release func(), ok bool) {
+	if !conflictsAtRuntime(source, ptype) {
+		return func() {}, true
+	}
+
+	select {
+	case a.cpuTraceSem <- struct{}{}:
+		return func() { <-a.cpuTraceSem }, true
+	case <-stop:
+		return nil, false
+	case <-ctx.Done():
+		return nil, false
+	}
+}
+
+// runScheduledType runs an independent collection loop for a single profile
+// type from source, on its own schedule. Profile types that don't conflict
+// at the runtime level (everything but CPU and trace collected from a
+// LocalSource) run fully concurrently with one another.
+func (a *Agent) runScheduledType(ctx context.Context, source Source, instance string, ptype profile.ProfileType) {
+	sched := a.scheduleFor(ptype)
+	pool := a.bufPool(ptype)
+
+	timer := time.NewTimer(tickInterval(0))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-a.stop:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			return
+		case <-timer.C:
+			release, ok := a.acquireCPUTrace(ctx, source, ptype, a.stop)
+			if !ok {
+				return
+			}
+
+			buf, _ := pool.Get().(*bytes.Buffer)
+			buf.Reset()
+			a.collectOnce(ctx, source, ptype, instance, "", buf)
+			pool.Put(buf)
+
+			release()
+
+			timer.Reset(tickInterval(sched.interval))
+		}
+	}
+}
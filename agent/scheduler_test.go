@@ -0,0 +1,121 @@
+package agent
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/profefe/profefe/pkg/profile"
+)
+
+func TestConflictsAtRuntime(t *testing.T) {
+	local := &LocalSource{}
+
+	tests := []struct {
+		name   string
+		source Source
+		ptype  profile.ProfileType
+		want   bool
+	}{
+		{"local cpu", local, profile.TypeCPU, true},
+		{"local trace", local, profile.TypeTrace, true},
+		{"local heap", local, profile.TypeHeap, false},
+		{"remote cpu", &HTTPPprofSource{}, profile.TypeCPU, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := conflictsAtRuntime(tt.source, tt.ptype); got != tt.want {
+				t.Errorf("conflictsAtRuntime(%s, %v) = %v, want %v", tt.name, tt.ptype, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAcquireCPUTraceSerializesLocalCPUAndTrace(t *testing.T) {
+	a := New("http://example.invalid", "svc")
+	source := &LocalSource{}
+
+	var running int32
+	var maxConcurrent int32
+	var wg sync.WaitGroup
+
+	run := func(ptype profile.ProfileType) {
+		defer wg.Done()
+		release, ok := a.acquireCPUTrace(context.Background(), source, ptype, a.stop)
+		if !ok {
+			t.Errorf("acquireCPUTrace(%v) = false, want true", ptype)
+			return
+		}
+		defer release()
+
+		n := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxConcurrent)
+			if n <= max || atomic.CompareAndSwapInt32(&maxConcurrent, max, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+	}
+
+	wg.Add(2)
+	go run(profile.TypeCPU)
+	go run(profile.TypeTrace)
+	wg.Wait()
+
+	if maxConcurrent > 1 {
+		t.Errorf("acquireCPUTrace let %d local CPU/trace collections run concurrently, want at most 1", maxConcurrent)
+	}
+}
+
+func TestAcquireCPUTraceIgnoresNonConflictingTypes(t *testing.T) {
+	a := New("http://example.invalid", "svc")
+	source := &LocalSource{}
+
+	release1, ok := a.acquireCPUTrace(context.Background(), source, profile.TypeHeap, a.stop)
+	if !ok {
+		t.Fatal("acquireCPUTrace(heap) = false, want true")
+	}
+	defer release1()
+
+	// A second, non-conflicting acquire must not block behind the first.
+	done := make(chan struct{})
+	go func() {
+		release2, ok := a.acquireCPUTrace(context.Background(), source, profile.TypeGoroutine, a.stop)
+		if !ok {
+			t.Error("acquireCPUTrace(goroutine) = false, want true")
+		} else {
+			release2()
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("acquireCPUTrace blocked on a non-conflicting profile type")
+	}
+}
+
+func TestAcquireCPUTraceReturnsFalseOnStop(t *testing.T) {
+	a := New("http://example.invalid", "svc")
+	source := &LocalSource{}
+
+	// Hold the semaphore so the next acquire has to wait on stop.
+	release, ok := a.acquireCPUTrace(context.Background(), source, profile.TypeCPU, a.stop)
+	if !ok {
+		t.Fatal("acquireCPUTrace(cpu) = false, want true")
+	}
+	defer release()
+
+	stop := make(chan struct{})
+	close(stop)
+
+	if _, ok := a.acquireCPUTrace(context.Background(), source, profile.TypeTrace, stop); ok {
+		t.Error("acquireCPUTrace() = true after stop closed, want false")
+	}
+}
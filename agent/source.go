@@ -0,0 +1,193 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"runtime/pprof"
+	"runtime/trace"
+	"time"
+
+	"github.com/profefe/profefe/pkg/profile"
+)
+
+// Source collects a single profile of the given type and writes its
+// pprof-encoded bytes to w. Implementations decide where the profile data
+// actually comes from: the running process itself, a remote process
+// exposing net/http/pprof, or anything else.
+type Source interface {
+	CollectProfile(ctx context.Context, ptype profile.ProfileType, w io.Writer) error
+}
+
+// instanceLabeler is implemented by Sources that can name the instance they
+// collect from, so that profiles collected via WithMultiSource can be told
+// apart on the collector side.
+type instanceLabeler interface {
+	InstanceLabel() string
+}
+
+// collectDurationKey overrides a Source's configured duration for a single
+// CollectProfile call, letting the Agent's per-type duration (WithSchedule's,
+// or else its CPUProfileDuration or TraceDuration, see scheduleFor) reach the
+// Source without changing the Source interface itself.
+type collectDurationKey struct{ ptype profile.ProfileType }
+
+func withCollectDuration(ctx context.Context, ptype profile.ProfileType, d time.Duration) context.Context {
+	if d <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, collectDurationKey{ptype}, d)
+}
+
+// collectDuration returns the duration the Agent set for ptype on ctx, or
+// fallback if none was set.
+func collectDuration(ctx context.Context, ptype profile.ProfileType, fallback time.Duration) time.Duration {
+	if d, ok := ctx.Value(collectDurationKey{ptype}).(time.Duration); ok {
+		return d
+	}
+	return fallback
+}
+
+// LocalSource collects profiles from the current process using
+// runtime/pprof and runtime/trace. This is the Agent's original, in-process
+// behavior.
+type LocalSource struct {
+	// CPUProfileDuration is how long to sample the CPU profile for.
+	CPUProfileDuration time.Duration
+	// TraceDuration is how long to record the execution trace for.
+	TraceDuration time.Duration
+}
+
+func (s *LocalSource) CollectProfile(ctx context.Context, ptype profile.ProfileType, w io.Writer) error {
+	switch ptype {
+	case profile.TypeCPU:
+		if err := pprof.StartCPUProfile(w); err != nil {
+			return fmt.Errorf("failed to start CPU profile: %v", err)
+		}
+		sleep(collectDuration(ctx, profile.TypeCPU, s.CPUProfileDuration), ctx.Done())
+		pprof.StopCPUProfile()
+	case profile.TypeHeap:
+		if err := pprof.WriteHeapProfile(w); err != nil {
+			return fmt.Errorf("failed to write heap profile: %v", err)
+		}
+	case profile.TypeBlock,
+		profile.TypeMutex,
+		profile.TypeGoroutine,
+		profile.TypeThreadcreate:
+
+		p := pprof.Lookup(ptype.String())
+		if p == nil {
+			return fmt.Errorf("unknown profile type %v", ptype)
+		}
+		if err := p.WriteTo(w, 0); err != nil {
+			return fmt.Errorf("failed to write %s profile: %v", ptype, err)
+		}
+	case profile.TypeTrace:
+		if err := trace.Start(w); err != nil {
+			return fmt.Errorf("failed to start trace: %v", err)
+		}
+		sleep(collectDuration(ctx, profile.TypeTrace, s.TraceDuration), ctx.Done())
+		trace.Stop()
+	default:
+		return fmt.Errorf("unknown profile type %v", ptype)
+	}
+
+	return nil
+}
+
+// HTTPPprofSource collects profiles from a remote process exposing the
+// standard net/http/pprof endpoints. This lets a single profefe agent
+// sidecar profile other co-located processes, including ones that can't
+// link the agent themselves.
+type HTTPPprofSource struct {
+	// Addr is the base URL of the target process, e.g. "http://10.0.1.5:6060".
+	Addr string
+
+	// Client is used to perform the HTTP requests. Defaults to
+	// http.DefaultClient.
+	Client httpClient
+
+	// CPUProfileDuration is sent as the `seconds` query parameter for the
+	// CPU profile endpoint. Defaults to defaultDuration. A duration the
+	// Agent sets for the collection (see collectDuration) takes precedence.
+	CPUProfileDuration time.Duration
+
+	// TraceDuration is sent as the `seconds` query parameter for the
+	// execution trace endpoint. Defaults to defaultDuration. A duration the
+	// Agent sets for the collection (see collectDuration) takes precedence.
+	TraceDuration time.Duration
+}
+
+func (s *HTTPPprofSource) CollectProfile(ctx context.Context, ptype profile.ProfileType, w io.Writer) error {
+	path, err := s.pprofPath(ctx, ptype)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, s.Addr+path, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s profile from %s: %v", ptype, s.Addr, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected response from %s: %s: %s", s.Addr, resp.Status, body)
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// InstanceLabel derives a label identifying the remote instance from its
+// address, so multi-source collection can tell profiles apart.
+func (s *HTTPPprofSource) InstanceLabel() string {
+	u, err := url.Parse(s.Addr)
+	if err != nil || u.Host == "" {
+		return s.Addr
+	}
+	return u.Host
+}
+
+func (s *HTTPPprofSource) pprofPath(ctx context.Context, ptype profile.ProfileType) (string, error) {
+	switch ptype {
+	case profile.TypeCPU:
+		dur := collectDuration(ctx, profile.TypeCPU, s.CPUProfileDuration)
+		if dur <= 0 {
+			dur = defaultDuration
+		}
+		return fmt.Sprintf("/debug/pprof/profile?seconds=%d", int(dur.Seconds())), nil
+	case profile.TypeHeap:
+		return "/debug/pprof/heap", nil
+	case profile.TypeBlock:
+		return "/debug/pprof/block", nil
+	case profile.TypeMutex:
+		return "/debug/pprof/mutex", nil
+	case profile.TypeGoroutine:
+		return "/debug/pprof/goroutine", nil
+	case profile.TypeThreadcreate:
+		return "/debug/pprof/threadcreate", nil
+	case profile.TypeTrace:
+		dur := collectDuration(ctx, profile.TypeTrace, s.TraceDuration)
+		if dur <= 0 {
+			dur = defaultDuration
+		}
+		return fmt.Sprintf("/debug/pprof/trace?seconds=%d", int(dur.Seconds())), nil
+	default:
+		return "", fmt.Errorf("unknown profile type %v", ptype)
+	}
+}
@@ -0,0 +1,322 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/profefe/profefe/pkg/profile"
+)
+
+// Trigger captures profiles in response to a condition rather than on a
+// fixed tick. Wait blocks until the condition is met (or ctx is done) and
+// reports which profile type to collect and a human-readable reason, which
+// the Agent attaches as a label on the uploaded profile so operators can
+// correlate the capture with the anomaly that produced it.
+//
+// A Trigger that wants a full set of profiles rather than a single type can
+// return profile.TypeUnknown; the Agent then captures every profile type it
+// is configured to collect.
+type Trigger interface {
+	Wait(ctx context.Context) (ptype profile.ProfileType, reason string, err error)
+}
+
+// WithTrigger adds a Trigger-driven collection loop alongside the Agent's
+// periodic one. Profiles captured this way are labeled with the reason the
+// trigger fired.
+func WithTrigger(t Trigger) Option {
+	return func(a *Agent) {
+		a.trigger = t
+	}
+}
+
+// triggerResult carries the outcome of a Trigger.Wait call back to
+// runTrigger's select loop.
+type triggerResult struct {
+	ptype  profile.ProfileType
+	reason string
+	err    error
+}
+
+func (a *Agent) runTrigger(ctx context.Context, trigger Trigger) {
+	source := &LocalSource{CPUProfileDuration: a.CPUProfileDuration, TraceDuration: a.TraceDuration}
+
+	// Canceling ctx on a.stop lets well-behaved Triggers return promptly;
+	// racing the select below against a.stop directly below makes Stop
+	// return even for a Trigger that ignores ctx and blocks forever.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-a.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var buf bytes.Buffer
+	var failures int
+	for {
+		resCh := make(chan triggerResult, 1)
+		go func() {
+			ptype, reason, err := trigger.Wait(ctx)
+			resCh <- triggerResult{ptype, reason, err}
+		}()
+
+		var res triggerResult
+		select {
+		case <-a.stop:
+			return
+		case res = <-resCh:
+		}
+
+		if res.err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			a.logf("[FAIL] trigger failed: %v", res.err)
+
+			// A Trigger that fails before it can block on its own poll
+			// interval (e.g. CPUThresholdTrigger when /proc/self/stat isn't
+			// readable) would otherwise spin this loop as fast as the CPU
+			// allows; back off between retries like sendProfile does.
+			failures++
+			delay := backoffMinDelay << uint(failures-1)
+			if delay > backoffMaxDelay || delay <= 0 {
+				delay = backoffMaxDelay
+			}
+			sleep(delay, a.stop)
+			continue
+		}
+		failures = 0
+
+		types := []profile.ProfileType{res.ptype}
+		if res.ptype == profile.TypeUnknown {
+			types = a.enabledProfileTypes()
+		}
+
+		for _, pt := range types {
+			release, ok := a.acquireCPUTrace(ctx, source, pt, a.stop)
+			if !ok {
+				return
+			}
+			a.collectOnce(ctx, source, pt, "", "reason="+res.reason, &buf)
+			release()
+		}
+	}
+}
+
+// CPUThresholdTrigger fires a CPU profile when the process's CPU usage
+// stays above Threshold (as a percentage of a single core, e.g. 80 for 80%)
+// for at least Sustained. It samples /proc/self/stat, so it only works on
+// Linux.
+type CPUThresholdTrigger struct {
+	Threshold    float64
+	Sustained    time.Duration
+	PollInterval time.Duration
+}
+
+func (t *CPUThresholdTrigger) pollInterval() time.Duration {
+	if t.PollInterval > 0 {
+		return t.PollInterval
+	}
+	return time.Second
+}
+
+func (t *CPUThresholdTrigger) Wait(ctx context.Context) (profile.ProfileType, string, error) {
+	poll := t.pollInterval()
+
+	var above time.Duration
+
+	prevTicks, prevAt, err := readProcessCPUTicks()
+	if err != nil {
+		return profile.TypeUnknown, "", fmt.Errorf("cpu threshold trigger: %v", err)
+	}
+
+	timer := time.NewTimer(poll)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return profile.TypeUnknown, "", ctx.Err()
+		case <-timer.C:
+			ticks, at, err := readProcessCPUTicks()
+			if err != nil {
+				return profile.TypeUnknown, "", fmt.Errorf("cpu threshold trigger: %v", err)
+			}
+
+			elapsed := at.Sub(prevAt)
+			pct := 100 * float64(ticks-prevTicks) / clockTicksPerSecond / elapsed.Seconds()
+			prevTicks, prevAt = ticks, at
+
+			if pct >= t.Threshold {
+				above += elapsed
+			} else {
+				above = 0
+			}
+
+			if above >= t.Sustained {
+				return profile.TypeCPU, fmt.Sprintf("cpu %.1f%% >= %.1f%% for %s", pct, t.Threshold, t.Sustained), nil
+			}
+
+			timer.Reset(poll)
+		}
+	}
+}
+
+const clockTicksPerSecond = 100 // USER_HZ, standard on Linux
+
+// readProcessCPUTicks returns the process's total CPU ticks (utime+stime)
+// from /proc/self/stat, and the time it was read at.
+func readProcessCPUTicks() (ticks uint64, at time.Time, err error) {
+	data, err := ioutil.ReadFile("/proc/self/stat")
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	at = time.Now()
+
+	ticks, err = parseStatCPUTicks(data)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return ticks, at, nil
+}
+
+// parseStatCPUTicks extracts utime+stime, in clock ticks, from the contents
+// of a /proc/[pid]/stat file.
+func parseStatCPUTicks(data []byte) (uint64, error) {
+	// fields are space separated; the 2nd field, comm, may itself contain
+	// spaces and is wrapped in parens, so skip past its closing paren first.
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return 0, fmt.Errorf("unexpected /proc/self/stat contents")
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	// utime is field 14, stime is field 15 overall; after dropping the first
+	// two fields (pid, comm) that's index 11 and 12.
+	if len(fields) < 13 {
+		return 0, fmt.Errorf("unexpected /proc/self/stat contents")
+	}
+
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return utime + stime, nil
+}
+
+// HeapGrowthTrigger fires a heap profile when runtime.MemStats.HeapInuse
+// grows by at least GrowthBytes within a single PollInterval.
+type HeapGrowthTrigger struct {
+	GrowthBytes  uint64
+	PollInterval time.Duration
+}
+
+func (t *HeapGrowthTrigger) pollInterval() time.Duration {
+	if t.PollInterval > 0 {
+		return t.PollInterval
+	}
+	return time.Second
+}
+
+func (t *HeapGrowthTrigger) Wait(ctx context.Context) (profile.ProfileType, string, error) {
+	poll := t.pollInterval()
+
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	prev := m.HeapInuse
+
+	timer := time.NewTimer(poll)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return profile.TypeUnknown, "", ctx.Err()
+		case <-timer.C:
+			runtime.ReadMemStats(&m)
+			growth := int64(m.HeapInuse) - int64(prev)
+			prev = m.HeapInuse
+
+			if growth >= int64(t.GrowthBytes) {
+				return profile.TypeHeap, fmt.Sprintf("heap grew by %d bytes in %s", growth, poll), nil
+			}
+
+			timer.Reset(poll)
+		}
+	}
+}
+
+// GoroutineCountTrigger fires a goroutine profile when the number of live
+// goroutines crosses Limit.
+type GoroutineCountTrigger struct {
+	Limit        int
+	PollInterval time.Duration
+}
+
+func (t *GoroutineCountTrigger) pollInterval() time.Duration {
+	if t.PollInterval > 0 {
+		return t.PollInterval
+	}
+	return time.Second
+}
+
+func (t *GoroutineCountTrigger) Wait(ctx context.Context) (profile.ProfileType, string, error) {
+	poll := t.pollInterval()
+
+	timer := time.NewTimer(poll)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return profile.TypeUnknown, "", ctx.Err()
+		case <-timer.C:
+			n := runtime.NumGoroutine()
+			if n > t.Limit {
+				return profile.TypeGoroutine, fmt.Sprintf("goroutine count %d > %d", n, t.Limit), nil
+			}
+			timer.Reset(poll)
+		}
+	}
+}
+
+// SignalTrigger fires the full set of enabled profiles whenever one of
+// Signals is received; it defaults to SIGUSR1.
+type SignalTrigger struct {
+	Signals []os.Signal
+
+	ch chan os.Signal
+}
+
+func (t *SignalTrigger) Wait(ctx context.Context) (profile.ProfileType, string, error) {
+	if t.ch == nil {
+		sigs := t.Signals
+		if len(sigs) == 0 {
+			sigs = []os.Signal{syscall.SIGUSR1}
+		}
+		t.ch = make(chan os.Signal, 1)
+		signal.Notify(t.ch, sigs...)
+	}
+
+	select {
+	case <-ctx.Done():
+		return profile.TypeUnknown, "", ctx.Err()
+	case sig := <-t.ch:
+		return profile.TypeUnknown, fmt.Sprintf("signal %v", sig), nil
+	}
+}
@@ -0,0 +1,53 @@
+package agent
+
+import "testing"
+
+func TestParseStatCPUTicks(t *testing.T) {
+	tests := []struct {
+		name    string
+		stat    string
+		want    uint64
+		wantErr bool
+	}{
+		{
+			name: "normal comm",
+			stat: "1234 (myproc) S 1 1234 1234 0 -1 4194304 100 0 0 0 111 222 0 0 20 0 4 0 12345 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0",
+			want: 111 + 222,
+		},
+		{
+			name: "comm contains spaces and parens",
+			stat: "1234 (my proc (worker)) S 1 1234 1234 0 -1 4194304 100 0 0 0 333 444 0 0 20 0 4 0 12345 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0",
+			want: 333 + 444,
+		},
+		{
+			name:    "too few fields after comm",
+			stat:    "1234 (myproc) S 1 1234 1234 0 -1 4194304",
+			wantErr: true,
+		},
+		{
+			name:    "missing comm closing paren",
+			stat:    "1234 myproc S 1 1234",
+			wantErr: true,
+		},
+		{
+			name:    "non-numeric utime",
+			stat:    "1234 (myproc) S 1 1234 1234 0 -1 4194304 100 0 0 0 nope 222 0 0 20 0 4 0 12345 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseStatCPUTicks([]byte(tt.stat))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseStatCPUTicks() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got != tt.want {
+				t.Errorf("parseStatCPUTicks() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}